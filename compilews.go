@@ -0,0 +1,104 @@
+// Copyright 2013 Christopher Swenson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// wsMessage is the wire format both directions of /compilews use: the
+// client sends "source", "stdin", and "kill" frames; the server sends
+// "stdout", "stderr", "exit", and "build_error" frames.
+type wsMessage struct {
+	Kind string `json:"kind"`
+	Data string `json:"data"`
+}
+
+func sendEvent(conn *wsConn, kind EventKind, data string) error {
+	b, err := json.Marshal(wsMessage{Kind: string(kind), Data: data})
+	if err != nil {
+		return err
+	}
+	return conn.WriteText(b)
+}
+
+// CompileStream is the /compilews WebSocket handler: it builds the
+// source sent in the first frame, then streams the running program's
+// stdout/stderr to the client as they're produced, rather than
+// buffering the whole run like Compile does. A client "stdin" frame is
+// forwarded to the program; a "kill" frame (or the client going away)
+// terminates it.
+func CompileStream(w http.ResponseWriter, req *http.Request) {
+	conn, err := wsUpgrade(w, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer conn.Close()
+
+	raw, err := conn.ReadMessage()
+	if err != nil {
+		return
+	}
+	var first wsMessage
+	if err := json.Unmarshal(raw, &first); err != nil || first.Kind != "source" {
+		sendEvent(conn, EventBuildError, `first frame must be {"kind":"source","data":"..."}`)
+		return
+	}
+
+	ctx := req.Context()
+	bin, buildOut, err := runner.Build(ctx, wrapSource([]byte(first.Data)))
+	if err != nil {
+		sendEvent(conn, EventBuildError, string(buildOut))
+		return
+	}
+	defer bin.Close()
+
+	events, stdin, kill, err := runner.Stream(ctx, bin)
+	if err != nil {
+		sendEvent(conn, EventBuildError, err.Error())
+		return
+	}
+	defer kill()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ev := range events {
+			if sendEvent(conn, ev.Kind, ev.Data) != nil {
+				kill()
+				return
+			}
+		}
+	}()
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for {
+			raw, err := conn.ReadMessage()
+			if err != nil {
+				kill()
+				return
+			}
+			var msg wsMessage
+			if json.Unmarshal(raw, &msg) != nil {
+				continue
+			}
+			switch msg.Kind {
+			case "stdin":
+				io.WriteString(stdin, msg.Data)
+			case "kill":
+				kill()
+			}
+		}
+	}()
+
+	<-done
+	conn.Close()
+	<-readDone
+}
@@ -0,0 +1,203 @@
+// Copyright 2013 Christopher Swenson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/format"
+	"go/scanner"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+// formatError is one diagnostic in a /format response, positioned
+// relative to the source the caller actually submitted (i.e. with any
+// package/func main wrapper this handler added back out of the line
+// numbers).
+type formatError struct {
+	Line int    `json:"line"`
+	Col  int    `json:"col"`
+	Msg  string `json:"msg"`
+}
+
+type formatResponse struct {
+	Body   string        `json:"body"`
+	Errors []formatError `json:"errors"`
+}
+
+// FormatSource is the /format HTTP handler: it gofmts the editor
+// buffer sent as the request body and, when the caller passes
+// ?imports=1, also resolves imports by shelling out to the goimports
+// binary named by -goimports. Because compile() synthesizes a
+// package/func main wrapper around a body that doesn't start with
+// "package" (so bare snippets still build), this handler applies the
+// same wrapper before formatting and strips it back out afterward, so
+// callers editing a bare snippet see just their snippet reformatted.
+func FormatSource(w http.ResponseWriter, req *http.Request) {
+	body := new(bytes.Buffer)
+	if _, err := body.ReadFrom(req.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wasWrapped := packageRe.Find(body.Bytes()) == nil
+	src := wrapSource(body.Bytes())
+	offset := 0
+	if wasWrapped {
+		offset = bodyLineOffset(src)
+	}
+
+	var out []byte
+	var errs []formatError
+	var err error
+	if req.URL.Query().Get("imports") == "1" {
+		out, errs, err = runGoimports(src)
+	} else {
+		out, err = format.Source(src)
+		if err != nil {
+			errs = scannerErrors(err)
+		}
+	}
+	if err != nil && len(errs) == 0 {
+		errs = []formatError{{Msg: err.Error()}}
+	}
+	for i := range errs {
+		errs[i].Line -= offset
+	}
+
+	resp := formatResponse{Errors: errs}
+	if err == nil {
+		if wasWrapped {
+			resp.Body = string(unwrapFormatted(out))
+		} else {
+			resp.Body = string(out)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// scannerErrors converts the scanner.ErrorList that go/format.Source
+// returns for a syntax error into our JSON error shape.
+func scannerErrors(err error) []formatError {
+	list, ok := err.(scanner.ErrorList)
+	if !ok {
+		return nil
+	}
+	errs := make([]formatError, len(list))
+	for i, e := range list {
+		errs[i] = formatError{Line: e.Pos.Line, Col: e.Pos.Column, Msg: e.Msg}
+	}
+	return errs
+}
+
+// goimportsErrorRe matches goimports' "file:line:col: message" error
+// lines (it reports the filename as "<standard input>" when reading
+// from stdin).
+var goimportsErrorRe = regexp.MustCompile(`^\S+:(\d+):(\d+):\s*(.*)$`)
+
+// runGoimports runs *goimportsPath over src via stdin/stdout.
+func runGoimports(src []byte) ([]byte, []formatError, error) {
+	cmd := exec.Command(*goimportsPath)
+	cmd.Stdin = bytes.NewReader(src)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		var errs []formatError
+		for _, line := range bytes.Split(stderr.Bytes(), []byte("\n")) {
+			m := goimportsErrorRe.FindSubmatch(line)
+			if m == nil {
+				continue
+			}
+			lineNo, _ := strconv.Atoi(string(m[1]))
+			col, _ := strconv.Atoi(string(m[2]))
+			errs = append(errs, formatError{Line: lineNo, Col: col, Msg: string(m[3])})
+		}
+		if len(errs) == 0 && stderr.Len() > 0 {
+			errs = []formatError{{Msg: stderr.String()}}
+		}
+		return nil, errs, err
+	}
+	return stdout.Bytes(), nil, nil
+}
+
+// wrapperFuncLine is the exact line wrapSource inserts to open the
+// synthesized func main, used to locate where the caller's snippet
+// starts (and, in unwrapFormatted, ends) inside the wrapped source.
+const wrapperFuncLine = "func main() {\n"
+
+// bodyLineOffset returns the 1-based line number of the first line of
+// the caller's snippet inside wrapped, i.e. how many lines wrapSource
+// added before it.
+func bodyLineOffset(wrapped []byte) int {
+	idx := bytes.Index(wrapped, []byte(wrapperFuncLine))
+	if idx < 0 {
+		return 0
+	}
+	return bytes.Count(wrapped[:idx], []byte("\n")) + 1
+}
+
+// wrapperFuncEmpty is the single-line form gofmt collapses an empty or
+// whitespace-only "func main() { ... }" to; wrapperFuncLine's "{\n"
+// search never matches it, since gofmt never emits a newline inside an
+// empty block.
+const wrapperFuncEmpty = "func main() {}"
+
+// unwrapFormatted reverses wrapSource on already-gofmt'd output: it
+// slices out the body of "func main() { ... }", removes the one tab
+// of indentation gofmt gives a top-level function's body, and
+// reattaches whatever import block now precedes func main — goimports
+// may have added or rewritten it, and it would otherwise be silently
+// dropped from the snippet handed back to the caller.
+func unwrapFormatted(formatted []byte) []byte {
+	if idx := bytes.Index(formatted, []byte(wrapperFuncLine)); idx >= 0 {
+		imports := importBlock(formatted[:idx])
+		body := formatted[idx+len(wrapperFuncLine):]
+		if i := bytes.LastIndex(body, []byte("}\n")); i >= 0 {
+			body = body[:i]
+		}
+		body = bytes.TrimRight(body, "\n")
+
+		lines := bytes.Split(body, []byte("\n"))
+		for i, l := range lines {
+			lines[i] = bytes.TrimPrefix(l, []byte("\t"))
+		}
+		return joinImports(imports, bytes.Join(lines, []byte("\n")))
+	}
+	if idx := bytes.Index(formatted, []byte(wrapperFuncEmpty)); idx >= 0 {
+		return joinImports(importBlock(formatted[:idx]), nil)
+	}
+	return formatted
+}
+
+// importBlock returns the import declaration(s) wrapSource's "package
+// main\n" line is followed by in prefix (everything in the formatted
+// source up to the wrapper's func main), or nil if there are none.
+func importBlock(prefix []byte) []byte {
+	idx := bytes.Index(prefix, []byte("package main\n"))
+	if idx < 0 {
+		return nil
+	}
+	return bytes.TrimSpace(prefix[idx+len("package main\n"):])
+}
+
+// joinImports prepends imports (if any) to body, the way a caller
+// who'd typed them inline in a bare snippet would expect to see them.
+func joinImports(imports, body []byte) []byte {
+	switch {
+	case len(imports) == 0:
+		return body
+	case len(body) == 0:
+		return imports
+	default:
+		return bytes.Join([][]byte{imports, body}, []byte("\n\n"))
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2013 Christopher Swenson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"go/format"
+	"strings"
+	"testing"
+)
+
+// TestUnwrapFormattedRoundTrip checks that formatting a bare snippet
+// through wrapSource and back via unwrapFormatted reproduces the
+// snippet, including the empty/whitespace-only edge case where
+// gofmt's handling of the synthesized func main body differs from the
+// non-empty case.
+func TestUnwrapFormattedRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"snippet", `fmt.Println("hi")`, `fmt.Println("hi")`},
+		{"empty", "", ""},
+		{"whitespace only", "   \n\t\n", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			formatted, err := format.Source(wrapSource([]byte(c.body)))
+			if err != nil {
+				t.Fatalf("format.Source: %v", err)
+			}
+			if got := string(unwrapFormatted(formatted)); got != c.want {
+				t.Errorf("unwrapFormatted(%q) = %q, want %q", formatted, got, c.want)
+			}
+		})
+	}
+}
+
+// TestUnwrapFormattedKeepsAddedImports checks that an import block
+// goimports added above the synthesized func main (which a bare
+// snippet never had to begin with) is kept in the unwrapped body
+// instead of being silently discarded.
+func TestUnwrapFormattedKeepsAddedImports(t *testing.T) {
+	// Stands in for what runGoimports would return for the snippet
+	// `fmt.Println("hi")`: the same wrapper, now with an import
+	// goimports resolved and the caller never wrote.
+	formatted := []byte("package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(\"hi\")\n}\n")
+
+	got := string(unwrapFormatted(formatted))
+	if !strings.Contains(got, `import "fmt"`) {
+		t.Errorf("unwrapFormatted(%q) = %q, want it to keep the added import", formatted, got)
+	}
+	if !strings.Contains(got, `fmt.Println("hi")`) {
+		t.Errorf("unwrapFormatted(%q) = %q, lost the snippet body", formatted, got)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2013 Christopher Swenson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"sync/atomic"
+)
+
+// newRunner builds the Runner selected by the -sandbox flag: a
+// LocalRunner when it's unset, or a SandboxRunner wrapping the named
+// backend otherwise.
+func newRunner() Runner {
+	if *sandbox == "" {
+		return &LocalRunner{CPUSeconds: *cpuSeconds}
+	}
+	backend, err := newSandboxBackend(*sandbox)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &SandboxRunner{Backend: backend, Timeout: *sandboxSec}
+}
+
+// maxOutputBytes bounds how much combined stdout/stderr a single build
+// or run step may produce before it is truncated. Untrusted programs
+// can otherwise wedge the server by writing gigabytes to stdout.
+const maxOutputBytes = 64 * 1024
+
+// Binary is a compiled program produced by a Runner's Build step and
+// later handed back to Run.
+type Binary interface {
+	// Path returns the on-disk location of the executable. Sandboxed
+	// implementations whose binary only exists inside a container may
+	// return "".
+	Path() string
+	// Close releases any resources (temp files, containers, jails)
+	// held on behalf of the binary.
+	Close() error
+}
+
+// A Runner builds and executes submitted Go source. Implementations
+// decide where that actually happens: LocalRunner execs directly on
+// the host, SandboxRunner isolates the build and the resulting binary
+// behind a container or namespace sandbox. Compile selects one based
+// on the -sandbox flag.
+type Runner interface {
+	// Build compiles src, a complete Go source file, and returns a
+	// Binary that Run can later execute. The returned error's output
+	// (if any) is the build log.
+	Build(ctx context.Context, src []byte) (Binary, []byte, error)
+	// Run executes bin, feeding it stdin and returning its combined,
+	// size-limited stdout/stderr.
+	Run(ctx context.Context, bin Binary, stdin io.Reader) ([]byte, error)
+	// Stream executes bin like Run, but returns its stdout/stderr as a
+	// live channel of Events instead of buffering the whole output, a
+	// writer for forwarding stdin, and a kill func that terminates the
+	// process (and, where the backend supports it, its whole process
+	// group). The channel is closed after a final EventExit event.
+	Stream(ctx context.Context, bin Binary) (events <-chan Event, stdin io.WriteCloser, kill func(), err error)
+}
+
+// EventKind identifies what an Event carries.
+type EventKind string
+
+const (
+	EventStdout     EventKind = "stdout"
+	EventStderr     EventKind = "stderr"
+	EventExit       EventKind = "exit"
+	EventBuildError EventKind = "build_error"
+)
+
+// Event is one message in a Runner.Stream channel: a chunk of output,
+// or the terminal exit/build_error notice.
+type Event struct {
+	Kind EventKind
+	Data string
+}
+
+// KillReason classifies why a sandboxed process produced no normal
+// exit, so the HTTP handler can tell the frontend something more
+// useful than a generic failure.
+type KillReason int
+
+const (
+	// KillNone means the process was not killed by the sandbox; any
+	// error is an ordinary build or runtime failure.
+	KillNone KillReason = iota
+	// KillTimeout means the process exceeded its wall-clock budget.
+	KillTimeout
+	// KillOOM means the process was killed for exceeding its memory
+	// limit.
+	KillOOM
+)
+
+// RunError wraps a build or run failure that the sandbox attributes to
+// a specific resource limit, so callers can distinguish "your program
+// has a bug" from "we killed your program".
+type RunError struct {
+	Reason KillReason
+	Err    error
+}
+
+func (e *RunError) Error() string {
+	switch e.Reason {
+	case KillTimeout:
+		return "process killed: time limit exceeded"
+	case KillOOM:
+		return "process killed: memory limit exceeded"
+	default:
+		return e.Err.Error()
+	}
+}
+
+func (e *RunError) Unwrap() error { return e.Err }
+
+// limitWriter accumulates at most limit bytes, silently discarding and
+// marking the rest as truncated rather than growing without bound.
+type limitWriter struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func newLimitWriter(limit int) *limitWriter {
+	return &limitWriter{limit: limit}
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if !w.truncated {
+		if remaining := w.limit - w.buf.Len(); remaining > 0 {
+			if len(p) > remaining {
+				w.buf.Write(p[:remaining])
+				w.truncated = true
+			} else {
+				w.buf.Write(p)
+			}
+		} else {
+			w.truncated = true
+		}
+	}
+	return len(p), nil
+}
+
+// Bytes returns the accumulated output, appending a marker if it was
+// truncated.
+func (w *limitWriter) Bytes() []byte {
+	if !w.truncated {
+		return w.buf.Bytes()
+	}
+	out := make([]byte, 0, w.buf.Len()+32)
+	out = append(out, w.buf.Bytes()...)
+	out = append(out, []byte("\n... (output truncated)")...)
+	return out
+}
+
+// normalizeBuildOutput drops the go tool's leading "# pkgname" build
+// comment and rewrites references to srcPath (the file actually passed
+// to `go build`) as "main.go", so build errors read the same
+// regardless of which runner or temp path produced them.
+func normalizeBuildOutput(out []byte, srcPath string) []byte {
+	out = commentRe.ReplaceAll(out, nil)
+	return bytes.Replace(out, []byte(srcPath+":"), []byte("main.go:"), -1)
+}
+
+// maxStreamBytes bounds the total stdout+stderr a single Stream call
+// will forward before it stops sending further output events; unlike
+// maxOutputBytes (buffered Run) this does not truncate mid-line, since
+// lines are already forwarded as they complete.
+const maxStreamBytes = 1 << 20 // 1 MiB
+
+// streamPipe copies complete lines from r to events as kind-tagged
+// Events until r is closed (the normal case, once the process exits)
+// or budget exceeds maxStreamBytes, in which case it sends one
+// truncation notice and stops forwarding further lines from this
+// pipe. budget is shared across the stdout and stderr goroutines of a
+// single Stream call.
+func streamPipe(r io.Reader, kind EventKind, events chan<- Event, budget *int64) {
+	buf := bufio.NewReader(r)
+	for {
+		line, err := buf.ReadString('\n')
+		if len(line) > 0 {
+			if atomic.AddInt64(budget, int64(len(line))) > maxStreamBytes {
+				events <- Event{Kind: kind, Data: "\n... (output truncated)\n"}
+				return
+			}
+			events <- Event{Kind: kind, Data: line}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// classifyExit turns a process exit/wait error into a *RunError when
+// the sandbox can attribute it to a timeout or an out-of-memory kill,
+// otherwise it returns err unchanged.
+func classifyExit(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return &RunError{Reason: KillTimeout, Err: err}
+	}
+	if isOOMKill(err) {
+		return &RunError{Reason: KillOOM, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,141 @@
+// Copyright 2013 Christopher Swenson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+)
+
+// LocalRunner builds and runs programs directly on the host, matching
+// sliderepl's original (pre-sandbox) behavior: it trusts the code it
+// is given. It is only safe for opt-in local use; production
+// deployments should pass -sandbox to get a SandboxRunner instead.
+type LocalRunner struct {
+	// CPUSeconds, if non-zero, caps the CPU time given to each build
+	// and run step (unix only; ignored on windows).
+	CPUSeconds int
+}
+
+type localBinary struct {
+	srcPath string
+	binPath string
+}
+
+func (b *localBinary) Path() string { return b.binPath }
+
+func (b *localBinary) Close() error {
+	os.Remove(b.srcPath)
+	return os.Remove(b.binPath)
+}
+
+func (r *LocalRunner) Build(ctx context.Context, src []byte) (Binary, []byte, error) {
+	x := filepath.Join(tmpdir, "compile"+strconv.Itoa(<-uniq))
+	srcPath := x + ".go"
+	binPath := x
+	if runtime.GOOS == "windows" {
+		binPath += ".exe"
+	}
+	if err := ioutil.WriteFile(srcPath, src, 0666); err != nil {
+		return nil, nil, err
+	}
+
+	dir, file := filepath.Split(srcPath)
+	out, err := r.exec(ctx, dir, "go", "build", "-o", binPath, file)
+	out = normalizeBuildOutput(out, file)
+	if err != nil {
+		os.Remove(srcPath)
+		return nil, out, err
+	}
+	return &localBinary{srcPath: srcPath, binPath: binPath}, out, nil
+}
+
+func (r *LocalRunner) Run(ctx context.Context, bin Binary, stdin io.Reader) ([]byte, error) {
+	lb := bin.(*localBinary)
+	return r.execStdin(ctx, lb.binPath, stdin)
+}
+
+func (r *LocalRunner) Stream(ctx context.Context, bin Binary) (<-chan Event, io.WriteCloser, func(), error) {
+	lb := bin.(*localBinary)
+
+	cmd := exec.Command(lb.binPath)
+	setProcessGroup(cmd)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	events := make(chan Event, 16)
+	var budget int64
+	var pending int32 = 2
+	streamDone := func() {
+		if atomic.AddInt32(&pending, -1) == 0 {
+			err := cmd.Wait()
+			events <- Event{Kind: EventExit, Data: exitMessage(err)}
+			close(events)
+		}
+	}
+	go func() {
+		streamPipe(stdout, EventStdout, events, &budget)
+		streamDone()
+	}()
+	go func() {
+		streamPipe(stderr, EventStderr, events, &budget)
+		streamDone()
+	}()
+
+	kill := func() { killProcessGroup(cmd) }
+	return events, stdin, kill, nil
+}
+
+func exitMessage(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
+
+// exec runs args in dir, bounding its output and CPU time.
+func (r *LocalRunner) exec(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	out := newLimitWriter(maxOutputBytes)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := withCPULimit(r.CPUSeconds, cmd)
+	return out.Bytes(), classifyExit(ctx, err)
+}
+
+// execStdin runs bin with stdin attached, bounding its output and CPU
+// time.
+func (r *LocalRunner) execStdin(ctx context.Context, bin string, stdin io.Reader) ([]byte, error) {
+	out := newLimitWriter(maxOutputBytes)
+	cmd := exec.CommandContext(ctx, bin)
+	cmd.Stdin = stdin
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := withCPULimit(r.CPUSeconds, cmd)
+	return out.Bytes(), classifyExit(ctx, err)
+}
@@ -0,0 +1,22 @@
+// Copyright 2013 Christopher Swenson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op on Windows, which has no POSIX process
+// group equivalent usable here.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills just the process itself on Windows.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	cmd.Process.Kill()
+}
@@ -0,0 +1,62 @@
+// Copyright 2013 Christopher Swenson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// rlimitChildArg marks a re-exec hop used by withCPULimit: when
+// sliderepl is invoked as "sliderepl rlimitChildArg seconds path
+// args...", it lowers its own RLIMIT_CPU to seconds and then execs
+// path/args in its place. RLIMIT_CPU only ever applies to the calling
+// process, so this is how the limit ends up on the child being
+// started rather than on the long-running server itself.
+const rlimitChildArg = "-sliderepl-rlimit-child"
+
+func init() {
+	if len(os.Args) < 4 || os.Args[1] != rlimitChildArg {
+		return
+	}
+	if seconds, err := strconv.Atoi(os.Args[2]); err == nil && seconds > 0 {
+		limit := syscall.Rlimit{Cur: uint64(seconds), Max: uint64(seconds)}
+		syscall.Setrlimit(syscall.RLIMIT_CPU, &limit)
+	}
+	args := os.Args[3:]
+	if err := syscall.Exec(args[0], args, os.Environ()); err != nil {
+		os.Stderr.WriteString("sliderepl: rlimit re-exec failed: " + err.Error() + "\n")
+		os.Exit(127)
+	}
+}
+
+// withCPULimit runs cmd with RLIMIT_CPU capped at seconds. It cannot
+// set the limit directly on the server process and exec cmd in the
+// usual way: rlimits are copied to a child at fork/exec time, but
+// RLIMIT_CPU counts the *whole* process's cumulative CPU time, so
+// lowering it on the server (a long-running process that keeps
+// accruing CPU across many requests) eventually drops the limit below
+// the server's own usage and the kernel delivers a self-inflicted
+// SIGXCPU. Instead, withCPULimit re-execs this binary as cmd's target,
+// with instructions (via rlimitChildArg, read back in init) to set the
+// limit on itself and then exec the real target in its place — by the
+// time the limit is set, the process is the child, not the server.
+func withCPULimit(seconds int, cmd *exec.Cmd) error {
+	if seconds <= 0 {
+		return cmd.Run()
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return cmd.Run()
+	}
+	cmd.Args = append([]string{self, rlimitChildArg, strconv.Itoa(seconds), cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = self
+	return cmd.Run()
+}
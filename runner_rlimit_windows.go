@@ -0,0 +1,17 @@
+// Copyright 2013 Christopher Swenson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package main
+
+import "os/exec"
+
+// withCPULimit is a no-op on Windows, which has no RLIMIT_CPU
+// equivalent; the wall-clock timeout enforced via context.Context is
+// still honored.
+func withCPULimit(seconds int, cmd *exec.Cmd) error {
+	return cmd.Run()
+}
@@ -0,0 +1,182 @@
+// Copyright 2013 Christopher Swenson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// defaultSandboxTimeout bounds a build or run step when -sandbox-timeout
+// is left at its zero value.
+const defaultSandboxTimeout = 10 * time.Second
+
+// SandboxBackend knows how to invoke `go build` and a built binary
+// inside some isolated environment. It is handed a host directory
+// containing main.go (and, for Run, the "bin" executable BuildCmd
+// produced inside that same directory) and returns the *exec.Cmd that
+// does the work; SandboxRunner takes care of timeouts and output
+// limits around it.
+type SandboxBackend interface {
+	// Name identifies the backend for log messages and errors.
+	Name() string
+	// BuildCmd compiles dir/main.go into dir/bin.
+	BuildCmd(ctx context.Context, dir string) *exec.Cmd
+	// RunCmd executes dir/bin, built by a prior BuildCmd.
+	RunCmd(ctx context.Context, dir string) *exec.Cmd
+}
+
+// Stopper is implemented by backends whose BuildCmd/RunCmd process can
+// outlive a local kill signal: docker/podman run is only a client
+// attached to a container the daemon keeps running, so killing that
+// client (on a context timeout or via Stream's kill func) wouldn't
+// stop the container. SandboxRunner calls Stop, when a backend
+// implements it, alongside every local kill to tear down what the
+// signal alone would miss; nsjail and bwrap don't need it, since their
+// process is the sandboxed program's direct parent.
+type Stopper interface {
+	Stop(dir string)
+}
+
+// SandboxRunner builds and runs submitted source inside an isolated
+// Backend (a disposable container or a namespace jail). It is
+// selected by the -sandbox flag in place of LocalRunner whenever
+// untrusted code may reach sliderepl.
+type SandboxRunner struct {
+	Backend SandboxBackend
+	// Timeout bounds the wall-clock time of each build and run step.
+	Timeout int // seconds
+}
+
+type sandboxBinary struct {
+	dir string
+}
+
+func (b *sandboxBinary) Path() string { return "" } // lives only inside the sandbox
+
+func (b *sandboxBinary) Close() error {
+	return os.RemoveAll(b.dir)
+}
+
+func (r *SandboxRunner) Build(ctx context.Context, src []byte) (Binary, []byte, error) {
+	dir, err := ioutil.TempDir(tmpdir, "sandbox")
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), src, 0666); err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+
+	out, err := r.run(ctx, dir, func(ctx context.Context) *exec.Cmd {
+		return r.Backend.BuildCmd(ctx, dir)
+	})
+	out = normalizeBuildOutput(out, "main.go")
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, out, err
+	}
+	return &sandboxBinary{dir: dir}, out, nil
+}
+
+func (r *SandboxRunner) Run(ctx context.Context, bin Binary, stdin io.Reader) ([]byte, error) {
+	sb := bin.(*sandboxBinary)
+	return r.run(ctx, sb.dir, func(ctx context.Context) *exec.Cmd {
+		cmd := r.Backend.RunCmd(ctx, sb.dir)
+		cmd.Stdin = stdin
+		return cmd
+	})
+}
+
+// Stream runs bin's RunCmd directly, without the wall-clock timeout
+// that Build/Run apply: a streamed program is expected to run for as
+// long as the client keeps its connection open, and is instead
+// terminated on demand via the returned kill func (e.g. a client
+// "kill" frame) or by cancelling ctx.
+func (r *SandboxRunner) Stream(ctx context.Context, bin Binary) (<-chan Event, io.WriteCloser, func(), error) {
+	sb := bin.(*sandboxBinary)
+	cmd := r.Backend.RunCmd(ctx, sb.dir)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	events := make(chan Event, 16)
+	var budget int64
+	var pending int32 = 2
+	streamDone := func() {
+		if atomic.AddInt32(&pending, -1) == 0 {
+			err := cmd.Wait()
+			events <- Event{Kind: EventExit, Data: exitMessage(err)}
+			close(events)
+		}
+	}
+	go func() {
+		streamPipe(stdout, EventStdout, events, &budget)
+		streamDone()
+	}()
+	go func() {
+		streamPipe(stderr, EventStderr, events, &budget)
+		streamDone()
+	}()
+
+	kill := func() {
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+		// Killing the wrapper process above is enough for nsjail/bwrap,
+		// which parent the sandboxed program directly; docker/podman's
+		// run is only a client attached to a container the daemon
+		// keeps running, so it additionally needs a Stop.
+		r.stopBackend(sb.dir)
+	}
+	return events, stdin, kill, nil
+}
+
+func (r *SandboxRunner) run(ctx context.Context, dir string, newCmd func(context.Context) *exec.Cmd) ([]byte, error) {
+	timeout := defaultSandboxTimeout
+	if r.Timeout > 0 {
+		timeout = time.Duration(r.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	out := newLimitWriter(maxOutputBytes)
+	cmd := newCmd(ctx)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		r.stopBackend(dir)
+	}
+	return out.Bytes(), classifyExit(ctx, err)
+}
+
+// stopBackend tells the Backend to tear down whatever it's running
+// for dir, for backends (currently only containerBackend) that
+// implement Stopper because a local kill signal isn't enough.
+func (r *SandboxRunner) stopBackend(dir string) {
+	if s, ok := r.Backend.(Stopper); ok {
+		s.Stop(dir)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2013 Christopher Swenson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// sandboxImage is the container image used to build and run submitted
+// programs; it needs nothing beyond the Go toolchain.
+const sandboxImage = "golang:1.21-alpine"
+
+// newSandboxBackend resolves the -sandbox flag value to a
+// SandboxBackend, or reports an error for an unknown name.
+func newSandboxBackend(name string) (SandboxBackend, error) {
+	switch name {
+	case "docker":
+		return &containerBackend{bin: "docker", memory: "128m", pids: 64}, nil
+	case "podman":
+		return &containerBackend{bin: "podman", memory: "128m", pids: 64}, nil
+	case "nsjail":
+		return &nsjailBackend{memoryMB: 128, pids: 64}, nil
+	case "bwrap":
+		return &bwrapBackend{}, nil
+	default:
+		return nil, fmt.Errorf("sliderepl: unknown -sandbox backend %q (want docker, podman, nsjail, or bwrap)", name)
+	}
+}
+
+// containerBackend runs builds and binaries inside a disposable
+// rootless container: no network, a read-only rootfs with a writable
+// tmpfs /tmp, and memory/pids caps.
+type containerBackend struct {
+	bin    string // "docker" or "podman"
+	memory string // e.g. "128m"
+	pids   int
+}
+
+func (b *containerBackend) Name() string { return b.bin }
+
+func (b *containerBackend) baseArgs(dir string) []string {
+	return []string{
+		"run", "--rm",
+		"--name", b.containerName(dir),
+		"--network=none",
+		"--read-only",
+		"--tmpfs", "/tmp",
+		// --read-only leaves no writable $HOME, and go build needs
+		// one for its build cache; point both at the /tmp tmpfs.
+		"-e", "HOME=/tmp",
+		"-e", "GOCACHE=/tmp/gocache",
+		"--memory", b.memory,
+		"--pids-limit", strconv.Itoa(b.pids),
+		"-v", dir + ":/sandbox",
+		"-w", "/sandbox",
+		sandboxImage,
+	}
+}
+
+// containerName derives a stable name for the container that builds
+// or runs dir's sandbox, from dir itself (the per-build temp directory
+// SandboxRunner created, so already unique). Stop uses the same name
+// to target that container later.
+func (b *containerBackend) containerName(dir string) string {
+	return "sliderepl-" + filepath.Base(dir)
+}
+
+func (b *containerBackend) BuildCmd(ctx context.Context, dir string) *exec.Cmd {
+	args := append(b.baseArgs(dir), "go", "build", "-o", "bin", "main.go")
+	return exec.CommandContext(ctx, b.bin, args...)
+}
+
+func (b *containerBackend) RunCmd(ctx context.Context, dir string) *exec.Cmd {
+	args := append(b.baseArgs(dir), "./bin")
+	return exec.CommandContext(ctx, b.bin, args...)
+}
+
+// Stop kills the running container for dir. docker/podman run is just
+// a client attached to a container the daemon actually runs; killing
+// that client process (on a context timeout, or via
+// SandboxRunner.Stream's kill func) leaves the container itself
+// running, and since --rm only fires on a normal container exit,
+// leaks it too. SandboxRunner calls Stop to tear down what a local
+// kill signal alone would miss.
+func (b *containerBackend) Stop(dir string) {
+	exec.Command(b.bin, "kill", b.containerName(dir)).Run()
+}
+
+// nsjailBackend isolates builds and binaries with nsjail, for Linux
+// hosts that don't have Docker or Podman available. Network access is
+// disabled by nsjail's default namespace isolation; pids are capped
+// via rlimit, memory via the memory cgroup (not RLIMIT_AS: the Go
+// runtime reserves hundreds of MB of virtual address space up front
+// regardless of RSS, so an RLIMIT_AS anywhere near a useful cap kills
+// the Go toolchain and every Go binary at startup). The jail's root is
+// an empty directory with only the Go toolchain and the sandbox dir
+// bind-mounted in, read-only except for /sandbox itself, so a
+// submitted program can't read arbitrary host files.
+type nsjailBackend struct {
+	memoryMB int64
+	pids     int
+}
+
+func (b *nsjailBackend) Name() string { return "nsjail" }
+
+// nsjailRootOnce and nsjailRoot lazily create the empty directory
+// nsjail chroots into; it holds nothing of its own; everything the
+// jailed program can see arrives via the bind mounts in baseArgs.
+var (
+	nsjailRootOnce sync.Once
+	nsjailRoot     string
+)
+
+func nsjailChrootRoot() string {
+	nsjailRootOnce.Do(func() {
+		nsjailRoot = filepath.Join(tmpdir, "nsjail-root")
+		os.MkdirAll(nsjailRoot, 0755)
+	})
+	return nsjailRoot
+}
+
+func (b *nsjailBackend) baseArgs(dir string) []string {
+	return []string{
+		"--mode", "o",
+		"--chroot", nsjailChrootRoot(),
+		"--bindmount_ro", "/usr:/usr",
+		"--bindmount_ro", "/usr/local/go:/usr/local/go",
+		"--bindmount_ro", "/dev:/dev",
+		"--bindmount", dir + ":/sandbox",
+		"--cwd", "/sandbox",
+		"--cgroup_mem_max", strconv.FormatInt(b.memoryMB*1024*1024, 10),
+		"--rlimit_nproc", strconv.Itoa(b.pids),
+		"--",
+	}
+}
+
+func (b *nsjailBackend) BuildCmd(ctx context.Context, dir string) *exec.Cmd {
+	args := append(b.baseArgs(dir), "go", "build", "-o", "bin", "main.go")
+	return exec.CommandContext(ctx, "nsjail", args...)
+}
+
+func (b *nsjailBackend) RunCmd(ctx context.Context, dir string) *exec.Cmd {
+	args := append(b.baseArgs(dir), "/sandbox/bin")
+	return exec.CommandContext(ctx, "nsjail", args...)
+}
+
+// bwrapBackend isolates builds and binaries with bubblewrap, a
+// lighter-weight alternative to nsjail available on most distros.
+// Unlike nsjail it has no built-in resource limiting, so it relies on
+// -sandbox-timeout (wall clock) for enforcement.
+type bwrapBackend struct{}
+
+func (b *bwrapBackend) Name() string { return "bwrap" }
+
+func (b *bwrapBackend) baseArgs(dir string) []string {
+	return []string{
+		"--ro-bind", "/usr", "/usr",
+		"--ro-bind", "/usr/local/go", "/usr/local/go",
+		"--symlink", "/usr/lib64", "/lib64",
+		"--proc", "/proc",
+		"--dev", "/dev",
+		"--tmpfs", "/tmp",
+		"--bind", dir, "/sandbox",
+		"--chdir", "/sandbox",
+		// bwrap gives the sandbox no $HOME, and go build needs a
+		// writable one for its build cache; point both at the /tmp
+		// tmpfs set up above.
+		"--setenv", "HOME", "/tmp",
+		"--setenv", "GOCACHE", "/tmp/gocache",
+		"--unshare-net",
+		"--die-with-parent",
+		"--new-session",
+	}
+}
+
+func (b *bwrapBackend) BuildCmd(ctx context.Context, dir string) *exec.Cmd {
+	args := append(b.baseArgs(dir), "go", "build", "-o", "bin", "main.go")
+	return exec.CommandContext(ctx, "bwrap", args...)
+}
+
+func (b *bwrapBackend) RunCmd(ctx context.Context, dir string) *exec.Cmd {
+	args := append(b.baseArgs(dir), "/sandbox/bin")
+	return exec.CommandContext(ctx, "bwrap", args...)
+}
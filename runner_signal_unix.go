@@ -0,0 +1,32 @@
+// Copyright 2013 Christopher Swenson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// isOOMKill reports whether err looks like a process killed for
+// exceeding a memory limit: either SIGKILL (what the Linux OOM killer
+// and nsjail/bwrap's rlimit enforcement send) or Docker/Podman's
+// documented exit code 137 for an OOM-killed container.
+func isOOMKill(err error) bool {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return false
+	}
+	if status.Signaled() && status.Signal() == syscall.SIGKILL {
+		return true
+	}
+	return status.ExitStatus() == 137
+}
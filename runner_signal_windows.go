@@ -0,0 +1,15 @@
+// Copyright 2013 Christopher Swenson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package main
+
+// isOOMKill always reports false on Windows: neither the SIGKILL nor
+// the container exit-code heuristics used on unix apply there, and
+// windows currently only supports the local runner.
+func isOOMKill(err error) bool {
+	return false
+}
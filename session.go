@@ -0,0 +1,267 @@
+// Copyright 2013 Christopher Swenson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Session tracks one presenter/audience sharing session enabled by
+// -session: the slide currently on screen and the most recent Compile
+// output, plus the live set of audience WebSocket subscribers to
+// notify when either changes.
+type Session struct {
+	mu          sync.Mutex
+	pin         string
+	slideIndex  int64
+	lastOutput  string
+	lastIsError bool
+	subscribers map[*wsConn]chan []byte
+}
+
+// sessionUpdate is the message broadcast to every subscriber of a
+// Session whenever its slide or output changes.
+type sessionUpdate struct {
+	Kind       string `json:"kind"`
+	SlideIndex int64  `json:"slideIndex"`
+	Output     string `json:"output"`
+	IsError    bool   `json:"isError"`
+}
+
+func (s *Session) snapshot() []byte {
+	s.mu.Lock()
+	msg := sessionUpdate{Kind: "state", SlideIndex: s.slideIndex, Output: s.lastOutput, IsError: s.lastIsError}
+	s.mu.Unlock()
+	b, _ := json.Marshal(msg)
+	return b
+}
+
+func (s *Session) broadcast() {
+	msg := s.snapshot()
+	s.mu.Lock()
+	chans := make([]chan []byte, 0, len(s.subscribers))
+	for _, ch := range s.subscribers {
+		chans = append(chans, ch)
+	}
+	s.mu.Unlock()
+	for _, ch := range chans {
+		select {
+		case ch <- msg:
+		default: // a slow subscriber misses a frame rather than blocking everyone else
+		}
+	}
+}
+
+// move advances (or rewinds) the presenter's current slide and
+// broadcasts the new state, clamped to the slide deck's bounds.
+func (s *Session) move(delta int64) {
+	s.mu.Lock()
+	next := s.slideIndex + delta
+	if next < 0 {
+		next = 0
+	} else if int(next) >= len(slides) {
+		next = s.slideIndex
+	}
+	s.slideIndex = next
+	s.mu.Unlock()
+	s.broadcast()
+}
+
+// compile runs src through the server's Runner exactly as Compile
+// does, records the result as the session's last output, and
+// broadcasts it to every subscriber.
+func (s *Session) compile(ctx context.Context, src string) {
+	out, isErr := runCompile(ctx, []byte(src))
+	s.mu.Lock()
+	s.lastOutput = string(out)
+	s.lastIsError = isErr
+	s.mu.Unlock()
+	s.broadcast()
+}
+
+// runCompile builds and runs src with the server's Runner, reporting
+// whether the result was a build/run error rather than returning it
+// as a Go error, since Session has no HTTP response to write one to.
+func runCompile(ctx context.Context, src []byte) (out []byte, isErr bool) {
+	bin, buildOut, err := runner.Build(ctx, wrapSource(src))
+	if err != nil {
+		return buildOut, true
+	}
+	defer bin.Close()
+	out, err = runner.Run(ctx, bin, nil)
+	return out, err != nil
+}
+
+// SessionHub creates and looks up Sessions by id. sessions, a single
+// process-wide SessionHub, backs the -session feature; sessions are
+// purely in-memory and do not survive a restart.
+type SessionHub struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func newSessionHub() *SessionHub {
+	return &SessionHub{sessions: make(map[string]*Session)}
+}
+
+var sessions = newSessionHub()
+
+// getOrCreate returns the Session for id, creating it — along with a
+// fresh presenter PIN logged to the server's console — the first time
+// id is requested.
+func (h *SessionHub) getOrCreate(id string) *Session {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.sessions[id]
+	if !ok {
+		s = &Session{pin: generatePIN(), subscribers: make(map[*wsConn]chan []byte)}
+		h.sessions[id] = s
+		log.Printf("session %q created; presenter PIN is %s", id, s.pin)
+	}
+	return s
+}
+
+// generatePIN returns a random 6-digit string, the shared secret a
+// browser must present (as ?pin=) to drive a session instead of just
+// watching it.
+func generatePIN() string {
+	var b [3]byte
+	rand.Read(b[:])
+	n := int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	return fmt.Sprintf("%06d", n%1000000)
+}
+
+// sessionDispatch routes /session/{id} to SessionPage and
+// /session/{id}/ws to SessionWS.
+func sessionDispatch(w http.ResponseWriter, req *http.Request) {
+	rest := strings.TrimPrefix(req.URL.Path, "/session/")
+	if rest == "" {
+		http.NotFound(w, req)
+		return
+	}
+	if id, ok := strings.CutSuffix(rest, "/ws"); ok {
+		SessionWS(w, req, id)
+		return
+	}
+	SessionPage(w, req, rest)
+}
+
+// SessionPageData is the template input for sessionPage: a PageData
+// for the slide currently on screen, plus which role this browser has
+// in the session.
+type SessionPageData struct {
+	PageData
+	ID        string
+	Presenter bool
+	PIN       string
+}
+
+// SessionPage renders the shared-session view of id's current slide:
+// an editable, compile-and-broadcast view for the presenter (the
+// browser that supplied the correct ?pin=), a read-only, live-updated
+// view for everyone else.
+func SessionPage(w http.ResponseWriter, req *http.Request, id string) {
+	s := sessions.getOrCreate(id)
+	presenter := req.URL.Query().Get("pin") == s.pin
+
+	s.mu.Lock()
+	idx := s.slideIndex
+	s.mu.Unlock()
+	if int(idx) >= len(slides) {
+		idx = 0
+	}
+	cur := slides[idx]
+
+	data := SessionPageData{
+		PageData: PageData{Title: cur.Title, Contents: cur.Contents, Notes: cur.Notes, Blocks: cur.Blocks},
+		ID:       id,
+	}
+	if presenter {
+		data.Presenter = true
+		data.PIN = s.pin
+	}
+	sessionPage.Execute(w, data)
+}
+
+// SessionWS is the /session/{id}/ws handler: it subscribes the
+// connection to id's broadcasts and, if the caller supplied the
+// correct ?pin=, also accepts "next", "prev", and "compile" control
+// frames from it. Audience connections (wrong or missing pin) may
+// only receive.
+func SessionWS(w http.ResponseWriter, req *http.Request, id string) {
+	s := sessions.getOrCreate(id)
+	presenter := req.URL.Query().Get("pin") == s.pin
+
+	conn, err := wsUpgrade(w, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer conn.Close()
+
+	ch := make(chan []byte, 8)
+	s.mu.Lock()
+	s.subscribers[conn] = ch
+	s.mu.Unlock()
+
+	conn.WriteText(s.snapshot())
+
+	// done tells the writer goroutine to stop, rather than closing ch:
+	// broadcast reads s.subscribers under s.mu and then sends to the
+	// channels it found after releasing it, so a send can still be in
+	// flight after this connection is removed from the map below.
+	// Closing ch at that point would race a send on a closed channel
+	// and panic; leaving ch open and unreferenced is harmless.
+	done := make(chan struct{})
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		for {
+			select {
+			case msg := <-ch:
+				if conn.WriteText(msg) != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		raw, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if !presenter {
+			continue
+		}
+		var m wsMessage
+		if json.Unmarshal(raw, &m) != nil {
+			continue
+		}
+		switch m.Kind {
+		case "next":
+			s.move(1)
+		case "prev":
+			s.move(-1)
+		case "compile":
+			s.compile(req.Context(), m.Data)
+		}
+	}
+
+	s.mu.Lock()
+	delete(s.subscribers, conn)
+	s.mu.Unlock()
+	close(done)
+	<-writeDone
+}
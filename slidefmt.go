@@ -0,0 +1,202 @@
+// Copyright 2013 Christopher Swenson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// BlockKind identifies the kind of content held by a Block.
+type BlockKind int
+
+const (
+	// BlockText is a paragraph, or (when Title is set) a "**"
+	// subsection heading.
+	BlockText BlockKind = iota
+	// BlockCode is a read-only, syntax-highlighted ".code" snippet.
+	BlockCode
+	// BlockPlay is an editable ".play" snippet wired to /compile.
+	BlockPlay
+	// BlockImage is an ".image" reference.
+	BlockImage
+	// BlockLink is a ".link" reference.
+	BlockLink
+	// BlockHTML is raw ".html" file contents, included verbatim.
+	BlockHTML
+)
+
+// Block is one piece of slide content in source order. Only the
+// fields relevant to Kind are populated.
+type Block struct {
+	Kind  BlockKind
+	Title string // subsection heading (BlockText) or link text (BlockLink)
+	Text  string // paragraph/bullet text (BlockText)
+	Code  string // source or HTML contents (BlockCode, BlockPlay, BlockHTML)
+	Path  string // referenced file or URL (BlockCode, BlockPlay, BlockImage, BlockLink)
+}
+
+var (
+	slideSectionRe    = regexp.MustCompile(`^\* (.+)$`)
+	slideSubsectionRe = regexp.MustCompile(`^\*\* (.+)$`)
+	slideCodeRe       = regexp.MustCompile(`^\.code\s+(\S+)(?:\s+(/[^/]*/),(/[^/]*/))?\s*$`)
+	slidePlayRe       = regexp.MustCompile(`^\.play\s+(\S+)\s*$`)
+	slideImageRe      = regexp.MustCompile(`^\.image\s+(\S+)\s*$`)
+	slideLinkRe       = regexp.MustCompile(`^\.link\s+(\S+)\s*(.*)$`)
+	slideHTMLRe       = regexp.MustCompile(`^\.html\s+(\S+)\s*$`)
+)
+
+// readSlideFile parses the present-style ".slide" format: sections
+// introduced by "* Title" become Slides, subsections by "** Title"
+// and plain paragraphs become BlockText blocks, and ".code", ".play",
+// ".image", ".link" and ".html" lines become the matching Block kind.
+// Any preamble before the first "* " section (deck title, author,
+// date) is ignored, since sliderepl only ever renders one section at
+// a time.
+func readSlideFile(path string) ([]Slide, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(path)
+
+	var slides []Slide
+	var cur *Slide
+	var para []string
+
+	flushPara := func() {
+		if len(para) == 0 {
+			return
+		}
+		text := strings.Join(para, "\n")
+		para = nil
+		cur.Blocks = append(cur.Blocks, Block{Kind: BlockText, Text: text})
+	}
+
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+
+		if m := slideSectionRe.FindStringSubmatch(line); m != nil {
+			flushPara()
+			if cur != nil {
+				slides = append(slides, *cur)
+			}
+			cur = &Slide{Title: m[1]}
+			continue
+		}
+		if cur == nil {
+			continue // preamble before the first section
+		}
+		switch {
+		case slideSubsectionRe.MatchString(line):
+			flushPara()
+			m := slideSubsectionRe.FindStringSubmatch(line)
+			cur.Blocks = append(cur.Blocks, Block{Kind: BlockText, Title: m[1]})
+		case strings.HasPrefix(line, ".code"):
+			flushPara()
+			m := slideCodeRe.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("%s: malformed .code directive: %q", path, line)
+			}
+			code, err := extractCode(dir, m[1], m[2], m[3])
+			if err != nil {
+				return nil, err
+			}
+			cur.Blocks = append(cur.Blocks, Block{Kind: BlockCode, Code: code, Path: m[1]})
+		case slidePlayRe.MatchString(line):
+			flushPara()
+			m := slidePlayRe.FindStringSubmatch(line)
+			code, err := ioutil.ReadFile(filepath.Join(dir, m[1]))
+			if err != nil {
+				return nil, err
+			}
+			cur.Blocks = append(cur.Blocks, Block{Kind: BlockPlay, Code: string(code), Path: m[1]})
+		case slideImageRe.MatchString(line):
+			flushPara()
+			m := slideImageRe.FindStringSubmatch(line)
+			cur.Blocks = append(cur.Blocks, Block{Kind: BlockImage, Path: m[1]})
+		case strings.HasPrefix(line, ".link"):
+			flushPara()
+			m := slideLinkRe.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("%s: malformed .link directive: %q", path, line)
+			}
+			cur.Blocks = append(cur.Blocks, Block{Kind: BlockLink, Path: m[1], Title: strings.TrimSpace(m[2])})
+		case slideHTMLRe.MatchString(line):
+			flushPara()
+			m := slideHTMLRe.FindStringSubmatch(line)
+			html, err := ioutil.ReadFile(filepath.Join(dir, m[1]))
+			if err != nil {
+				return nil, err
+			}
+			cur.Blocks = append(cur.Blocks, Block{Kind: BlockHTML, Code: string(html), Path: m[1]})
+		case strings.TrimSpace(line) == "":
+			flushPara()
+		default:
+			para = append(para, line)
+		}
+	}
+	flushPara()
+	if cur != nil {
+		slides = append(slides, *cur)
+	}
+	return slides, nil
+}
+
+// extractCode reads file relative to dir and, when startPat/endPat are
+// present-style regexp addresses such as "/START OMIT/" and
+// "/END OMIT/", returns only the inclusive line range between the
+// first line matching startPat and the next line matching endPat.
+// Lines containing the literal text "OMIT" (present's convention for
+// marking a line as elided from rendered output) are dropped.
+func extractCode(dir, file, startPat, endPat string) (string, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(string(raw), "\n")
+	if startPat == "" {
+		return stripOMIT(lines), nil
+	}
+
+	start, err := regexp.Compile(strings.Trim(startPat, "/"))
+	if err != nil {
+		return "", fmt.Errorf("%s: bad .code address %q: %v", file, startPat, err)
+	}
+	end, err := regexp.Compile(strings.Trim(endPat, "/"))
+	if err != nil {
+		return "", fmt.Errorf("%s: bad .code address %q: %v", file, endPat, err)
+	}
+
+	var out []string
+	in := false
+	for _, l := range lines {
+		if !in {
+			if !start.MatchString(l) {
+				continue
+			}
+			in = true
+		}
+		out = append(out, l)
+		if end.MatchString(l) {
+			break
+		}
+	}
+	return stripOMIT(out), nil
+}
+
+func stripOMIT(lines []string) string {
+	kept := make([]string, 0, len(lines))
+	for _, l := range lines {
+		if strings.Contains(l, "OMIT") {
+			continue
+		}
+		kept = append(kept, l)
+	}
+	return strings.Join(kept, "\n")
+}
@@ -7,32 +7,42 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"strconv"
 	"strings"
 	"text/template"
 )
 
 type Slide struct {
+	Title    string
 	Contents string
 	Notes    string
+	// Blocks holds the parsed content of a slide read from a ".slide"
+	// deck; it is empty for the legacy "slides.go" format, in which
+	// case Contents/Notes are used instead.
+	Blocks []Block
 }
 
 var (
-	httpListen = flag.String("http", "127.0.0.1:3999", "host:port to listen on")
-	htmlOutput = flag.Bool("html", false, "render program output as HTML")
-	slidesFile = flag.String("slides", "slides.go", "Slides file to read in")
-	staticHTML = flag.String("static", "", "write slides to static HTML file")
-	slides     []Slide
+	httpListen    = flag.String("http", "127.0.0.1:3999", "host:port to listen on")
+	htmlOutput    = flag.Bool("html", false, "render program output as HTML")
+	slidesFile    = flag.String("slides", "slides.go", "Slides file to read in")
+	staticHTML    = flag.String("static", "", "write slides to static HTML file")
+	sandbox       = flag.String("sandbox", "", "sandbox backend for running submitted code: docker, podman, nsjail, or bwrap (default: run locally, unsandboxed — only for trusted local use)")
+	cpuSeconds    = flag.Int("cpu-seconds", 5, "CPU time limit in seconds for the local runner (ignored when -sandbox is set)")
+	sandboxSec    = flag.Int("sandbox-timeout", 10, "wall-clock timeout in seconds for a sandboxed build or run")
+	sessionFlag   = flag.Bool("session", false, "enable the shared presenter/audience session feature at /session/{id}")
+	goimportsPath = flag.String("goimports", "goimports", "path to the goimports binary used by /format's ?imports=1 path")
+	slides        []Slide
+	runner        Runner
 )
 
 var (
@@ -50,6 +60,7 @@ func main() {
 		}
 	}()
 
+	runner = newRunner()
 	readSlides()
 	if *staticHTML != "" {
 		fmt.Println("Writing to file", *staticHTML)
@@ -62,12 +73,33 @@ func main() {
 	} else {
 		http.HandleFunc("/", FrontPage)
 		http.HandleFunc("/compile", Compile)
+		http.HandleFunc("/compilews", CompileStream)
+		http.HandleFunc("/format", FormatSource)
+		if *sessionFlag {
+			http.HandleFunc("/session/", sessionDispatch)
+		}
 		fmt.Printf("Listening on %s\n", *httpListen)
 		log.Fatal(http.ListenAndServe(*httpListen, nil))
 	}
 }
 
+// readSlides populates the global slides from *slidesFile. A ".slide"
+// extension selects the present-style Block-based parser; anything
+// else falls back to the original bespoke "slides.go" reader, so
+// existing decks keep working unchanged.
 func readSlides() {
+	if strings.EqualFold(filepath.Ext(*slidesFile), ".slide") {
+		s, err := readSlideFile(*slidesFile)
+		if err != nil {
+			panic(err)
+		}
+		slides = s
+		return
+	}
+	readLegacySlides()
+}
+
+func readLegacySlides() {
 	slidesRaw, err := ioutil.ReadFile(*slidesFile)
 	if err != nil {
 		panic(err)
@@ -84,13 +116,15 @@ func readSlides() {
 		if len(s) == 2 {
 			notes = strings.TrimSuffix(s[1], "*/")
 		}
-		slides = append(slides, Slide{s[0], notes})
+		slides = append(slides, Slide{Contents: s[0], Notes: notes})
 	}
 }
 
 type PageData struct {
+	Title     string
 	Contents  string
 	Notes     string
+	Blocks    []Block
 	PrevSlide int64
 	NextSlide int64
 }
@@ -101,27 +135,25 @@ type PageData struct {
 // Otherwise, the default "hello, world" program is displayed.
 func FrontPage(w http.ResponseWriter, req *http.Request) {
 	data, err := ioutil.ReadFile(req.URL.Path[1:])
-	notes := ""
 	slide := int64(0)
 	if s := req.URL.Query()["s"]; s != nil {
 		slide, _ = strconv.ParseInt(s[0], 10, 16)
 	}
-	var cont string
+	var params PageData
 	if err != nil {
-		cont = slides[slide].Contents
-		notes = slides[slide].Notes
+		cur := slides[slide]
+		params = PageData{Title: cur.Title, Contents: cur.Contents, Notes: cur.Notes, Blocks: cur.Blocks}
 	} else {
-		cont = string(data)
+		params = PageData{Contents: string(data)}
 	}
-	prevSlide := slide - 1
-	if prevSlide < 0 {
-		prevSlide = 0
+	params.PrevSlide = slide - 1
+	if params.PrevSlide < 0 {
+		params.PrevSlide = 0
 	}
-	nextSlide := slide + 1
-	if int(nextSlide) >= len(slides) {
-		nextSlide = slide
+	params.NextSlide = slide + 1
+	if int(params.NextSlide) >= len(slides) {
+		params.NextSlide = slide
 	}
-	params := PageData{cont, notes, prevSlide, nextSlide}
 	frontPage.Execute(w, params)
 }
 
@@ -159,71 +191,65 @@ func init() {
 	}
 }
 
-func compile(req *http.Request) (out []byte, err error) {
-	// x is the base name for .go, .6, executable files
-	x := filepath.Join(tmpdir, "compile"+strconv.Itoa(<-uniq))
-	src := x + ".go"
-	bin := x
-	if runtime.GOOS == "windows" {
-		bin += ".exe"
+// wrapSource synthesizes a "package main" and func main() wrapper
+// around body when it doesn't already start with "package", so bare
+// snippets (the common case when pasting from a slide) still build
+// and run on their own.
+func wrapSource(body []byte) []byte {
+	if packageRe.Find(body) != nil {
+		return body
 	}
+	newBody := new(bytes.Buffer)
+	newBody.WriteString("package main\n")
+	// move all import lines to the top
+	for _, importLine := range importRe.FindAll(body, -1) {
+		newBody.Write(importLine)
+		newBody.WriteRune(10)
+	}
+	newBody.WriteString("func main() {\n")
+	newBody.Write(importRe.ReplaceAll(body, nil))
+	newBody.WriteString("\n}\n")
+	return newBody.Bytes()
+}
 
-	// rewrite filename in error output
-	defer func() {
-		if err != nil {
-			// drop messages from the go tool like '# _/compile0'
-			out = commentRe.ReplaceAll(out, nil)
-		}
-		out = bytes.Replace(out, []byte(src+":"), []byte("main.go:"), -1)
-	}()
-
-	// write body to x.go
+func compile(req *http.Request) (out []byte, err error) {
 	body := new(bytes.Buffer)
 	if _, err = body.ReadFrom(req.Body); err != nil {
 		return
 	}
 
-	originalBodyBytes := body.Bytes()
-	var bodyBytes []byte
-
-	// check to see if the body starts with a "package"
-	if packageRe.Find(originalBodyBytes) == nil {
-		newBody := new(bytes.Buffer)
-		newBody.WriteString("package main\n")
-		// move all import lines to the top
-		for _, importLine := range importRe.FindAll(originalBodyBytes, -1) {
-			newBody.Write(importLine)
-			newBody.WriteRune(10)
-		}
-		newBody.WriteString("func main() {\n")
-		newBody.Write(importRe.ReplaceAll(originalBodyBytes, make([]byte, 0)))
-		newBody.WriteString("\n}\n")
-		bodyBytes = newBody.Bytes()
-	} else {
-		bodyBytes = originalBodyBytes
-	}
-
-	defer os.Remove(src)
-	if err = ioutil.WriteFile(src, bodyBytes, 0666); err != nil {
-		return
-	}
-
-	// build x.go, creating x
-	dir, file := filepath.Split(src)
-	out, err = run(dir, "go", "build", "-o", bin, file)
-	defer os.Remove(bin)
+	ctx := req.Context()
+	bin, buildOut, err := runner.Build(ctx, wrapSource(body.Bytes()))
 	if err != nil {
-		return
+		return buildOut, err
 	}
+	defer bin.Close()
 
-	// run x
-	return run("", bin)
+	return runner.Run(ctx, bin, nil)
 }
 
-// error writes compile, link, or runtime errors to the HTTP connection.
-// The JavaScript interface uses the 404 status code to identify the error.
+// error_ writes compile, link, runtime, or sandbox-kill errors to the
+// HTTP connection. The JavaScript interface uses the 404 status code
+// to identify an ordinary build/runtime error, and the
+// X-Sliderepl-Kill-Reason header plus a distinct status to identify a
+// timeout or an out-of-memory kill so the frontend can say so instead
+// of showing a generic failure.
 func error_(w http.ResponseWriter, out []byte, err error) {
-	w.WriteHeader(404)
+	var runErr *RunError
+	if errors.As(err, &runErr) {
+		switch runErr.Reason {
+		case KillTimeout:
+			w.Header().Set("X-Sliderepl-Kill-Reason", "timeout")
+			w.WriteHeader(http.StatusGatewayTimeout)
+		case KillOOM:
+			w.Header().Set("X-Sliderepl-Kill-Reason", "oom")
+			w.WriteHeader(http.StatusInsufficientStorage)
+		default:
+			w.WriteHeader(404)
+		}
+	} else {
+		w.WriteHeader(404)
+	}
 	if out != nil {
 		output.Execute(w, out)
 	} else {
@@ -231,20 +257,10 @@ func error_(w http.ResponseWriter, out []byte, err error) {
 	}
 }
 
-// run executes the specified command and returns its output and an error.
-func run(dir string, args ...string) ([]byte, error) {
-	var buf bytes.Buffer
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Dir = dir
-	cmd.Stdout = &buf
-	cmd.Stderr = cmd.Stdout
-	err := cmd.Run()
-	return buf.Bytes(), err
-}
-
 var frontPage = template.Must(template.New("frontPage").Parse(frontPageText)) // HTML template
 var staticPage = template.Must(template.New("staticPage").Parse(staticPageText))
 var output = template.Must(template.New("output").Parse(outputText)) // HTML template
+var sessionPage = template.Must(template.New("sessionPage").Parse(sessionPageText))
 
 var outputText = `<pre>{{printf "%s" . |html}}</pre>`
 
@@ -335,7 +351,22 @@ function onPageLoad() {
 <body onload="onPageLoad()">
 <table>
 {{range $i, $contents := .}}
-<tr class="slide" id="slide_{{printf "%d" $i }}"><td><pre>{{printf "%s" $contents.Contents |html}}</pre></td></tr>
+<tr class="slide" id="slide_{{printf "%d" $i }}"><td>
+{{if $contents.Blocks}}
+{{if $contents.Title}}<h2>{{$contents.Title}}</h2>{{end}}
+{{range $j, $b := $contents.Blocks}}
+{{if eq $b.Kind 0}}{{if $b.Title}}<h3>{{$b.Title}}</h3>{{else}}<p>{{printf "%s" $b.Text |html}}</p>{{end}}
+{{else if eq $b.Kind 1}}<pre class="code">{{printf "%s" $b.Code |html}}</pre>
+{{else if eq $b.Kind 2}}<pre class="code">{{printf "%s" $b.Code |html}}</pre>
+{{else if eq $b.Kind 3}}<img src="{{$b.Path}}">
+{{else if eq $b.Kind 4}}<a href="{{$b.Path}}">{{if $b.Title}}{{$b.Title}}{{else}}{{$b.Path}}{{end}}</a>
+{{else if eq $b.Kind 5}}{{printf "%s" $b.Code}}
+{{end}}
+{{end}}
+{{else}}
+<pre>{{printf "%s" $contents.Contents |html}}</pre>
+{{end}}
+</td></tr>
 {{end}}
 <tr class="controls"><td>
 <button id="noteButton" onclick="toggleNotes()">Show notes</button>
@@ -435,9 +466,40 @@ function keyHandler(event) {
 			autoindent(e.target);
 		}
 	}
+	if ((e.ctrlKey || e.metaKey) && e.shiftKey && e.keyCode == 70) { // ctrl/cmd+shift+F
+		formatSource();
+		preventDefault(e);
+		return false;
+	}
 	return true;
 }
 
+function formatSource() {
+	var prog = document.getElementById("edit").value;
+	var imports = document.getElementById("fiximports").checked;
+	var req = new XMLHttpRequest();
+	req.onreadystatechange = function() {
+		if (req.readyState != 4) {
+			return;
+		}
+		var resp = JSON.parse(req.responseText);
+		if (resp.errors && resp.errors.length > 0) {
+			var msgs = [];
+			for (var i = 0; i < resp.errors.length; i++) {
+				var e = resp.errors[i];
+				msgs.push(e.line + ":" + e.col + ": " + e.msg);
+			}
+			document.getElementById("errors").innerHTML = "<pre>" + escapeHTML(msgs.join("\n")) + "</pre>";
+		} else {
+			document.getElementById("edit").value = resp.body;
+			document.getElementById("errors").innerHTML = "";
+		}
+	};
+	req.open("POST", "/format" + (imports ? "?imports=1" : ""), true);
+	req.setRequestHeader("Content-Type", "text/plain; charset=utf-8");
+	req.send(prog);
+}
+
 var xmlreq;
 
 function autocompile() {
@@ -448,13 +510,60 @@ function autocompile() {
 }
 
 function compile() {
+	if (window.WebSocket) {
+		wsCompile();
+	} else {
+		xhrCompile();
+	}
+}
+
+function xhrCompile() {
 	var prog = document.getElementById("edit").value;
 	var req = new XMLHttpRequest();
 	xmlreq = req;
 	req.onreadystatechange = compileUpdate;
 	req.open("POST", "/compile", true);
 	req.setRequestHeader("Content-Type", "text/plain; charset=utf-8");
-	req.send(prog);	
+	req.send(prog);
+}
+
+// wsCompile streams the program's output live over /compilews as it
+// runs, instead of waiting for it to finish like xhrCompile. It falls
+// back to xhrCompile if the socket can't be opened.
+function wsCompile() {
+	var prog = document.getElementById("edit").value;
+	var proto = (window.location.protocol == "https:") ? "wss:" : "ws:";
+	var ws;
+	try {
+		ws = new WebSocket(proto + "//" + window.location.host + "/compilews");
+	} catch (e) {
+		xhrCompile();
+		return;
+	}
+	var out = "";
+	document.getElementById("output").innerHTML = "";
+	document.getElementById("errors").innerHTML = "";
+	ws.onopen = function() {
+		ws.send(JSON.stringify({kind: "source", data: prog}));
+	};
+	ws.onmessage = function(ev) {
+		var msg = JSON.parse(ev.data);
+		if (msg.kind == "stdout" || msg.kind == "stderr") {
+			out += msg.data;
+			document.getElementById("output").innerHTML = "<pre>" + escapeHTML(out) + "</pre>";
+		} else if (msg.kind == "build_error") {
+			document.getElementById("errors").innerHTML = "<pre>" + escapeHTML(msg.data) + "</pre>";
+		} else if (msg.kind == "exit") {
+			ws.close();
+		}
+	};
+	ws.onerror = function() {
+		xhrCompile();
+	};
+}
+
+function escapeHTML(s) {
+	return s.replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;");
 }
 
 function compileUpdate() {
@@ -466,11 +575,32 @@ function compileUpdate() {
 		document.getElementById("output").innerHTML = req.responseText;
 		document.getElementById("errors").innerHTML = "";
 	} else {
-		document.getElementById("errors").innerHTML = req.responseText;
+		var reason = req.getResponseHeader("X-Sliderepl-Kill-Reason");
+		if (reason == "timeout") {
+			document.getElementById("errors").innerHTML = "<pre>process killed: time limit exceeded</pre>";
+		} else if (reason == "oom") {
+			document.getElementById("errors").innerHTML = "<pre>process killed: memory limit exceeded</pre>";
+		} else {
+			document.getElementById("errors").innerHTML = req.responseText;
+		}
 		document.getElementById("output").innerHTML = "";
 	}
 }
 
+function runPlay(i) {
+	var prog = document.getElementById("play_" + i).value;
+	var req = new XMLHttpRequest();
+	req.onreadystatechange = function() {
+		if (req.readyState != 4) {
+			return;
+		}
+		document.getElementById("playout_" + i).innerHTML = req.responseText;
+	};
+	req.open("POST", "/compile", true);
+	req.setRequestHeader("Content-Type", "text/plain; charset=utf-8");
+	req.send(prog);
+}
+
 function toggleNotes() {
 	state = document.getElementById("notes").style.display
 	if (state=="none") {
@@ -493,11 +623,32 @@ function onPageLoad() {
 </script>
 </head>
 <body onload="onPageLoad()">
+{{if .Blocks}}
+{{if .Title}}<h2>{{.Title}}</h2>{{end}}
+{{range $i, $b := .Blocks}}
+{{if eq $b.Kind 0}}{{if $b.Title}}<h3>{{$b.Title}}</h3>{{else}}<p>{{printf "%s" $b.Text |html}}</p>{{end}}
+{{else if eq $b.Kind 1}}<pre class="code">{{printf "%s" $b.Code |html}}</pre>
+{{else if eq $b.Kind 2}}
+<textarea class="play" id="play_{{$i}}" spellcheck="false">{{printf "%s" $b.Code |html}}</textarea>
+<div class="hints"><button onclick="runPlay({{$i}})">Run</button></div>
+<pre id="playout_{{$i}}"></pre>
+{{else if eq $b.Kind 3}}<img src="{{$b.Path}}">
+{{else if eq $b.Kind 4}}<a href="{{$b.Path}}">{{if $b.Title}}{{$b.Title}}{{else}}{{$b.Path}}{{end}}</a>
+{{else if eq $b.Kind 5}}{{printf "%s" $b.Code}}
+{{end}}
+{{end}}
+<div class="hints">
+<button onclick="window.location.href = '/?s={{ printf "%d" .PrevSlide }}'">Previous</button>
+<button onclick="window.location.href = '/?s={{ printf "%d" .NextSlide }}'">Next</button>
+</div>
+{{else}}
 <table width="100%"><tr><td width="60%" valign="top">
 <textarea autofocus="true" id="edit" spellcheck="false" onkeydown="keyHandler(event);" onkeyup="autocompile();">{{printf "%s" .Contents |html}}</textarea>
 <div class="hints">
-(Shift-Enter to compile and run.)&nbsp;&nbsp;&nbsp;&nbsp;
+(Shift-Enter to compile and run, Ctrl-Shift-F to format.)&nbsp;&nbsp;&nbsp;&nbsp;
 <input type="checkbox" id="autocompile" value="checked" /> Compile and run after each keystroke
+<input type="checkbox" id="fiximports" /> Fix imports when formatting
+<button onclick="formatSource()">Format</button>
 <button id="noteButton" onclick="toggleNotes()">Hide notes</button>
 <button onclick="window.location.href = '/?s={{ printf "%d" .PrevSlide }}'">Previous</button>
 <button onclick="window.location.href = '/?s={{ printf "%d" .NextSlide }}'">Next</button>
@@ -509,6 +660,80 @@ function onPageLoad() {
 </table>
 <div id="errors"></div>
 <div id="notes">{{ printf "%s" .Notes |html}}</div>
+{{end}}
+</body>
+</html>
+`
+
+// sessionPageText renders a -session shared session: an editable,
+// compile-and-broadcast view for the presenter, a read-only,
+// live-updated view for everyone else. Unlike frontPageText, Next and
+// Compile don't hit /compile or reload the page — they send control
+// frames over the session's WebSocket, which broadcasts the result to
+// every connected audience member.
+var sessionPageText = `<!doctype html>
+<html>
+<head>
+<style>
+pre, textarea {
+	font-family: Monaco, 'Courier New', 'DejaVu Sans Mono', 'Bitstream Vera Sans Mono', monospace;
+	font-size: 100%;
+}
+#edit, #output { width: 100%; text-align: left; }
+#edit { height: 500px; }
+#output { color: #00c; }
+#output.error { color: #c00; }
+</style>
+<script>
+
+var ws;
+
+function escapeHTML(s) {
+	return s.replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;");
+}
+
+function connect() {
+	var proto = (window.location.protocol == "https:") ? "wss:" : "ws:";
+	var url = proto + "//" + window.location.host + "/session/{{.ID}}/ws";
+	{{if .Presenter}}url += "?pin={{.PIN}}";{{end}}
+	ws = new WebSocket(url);
+	ws.onmessage = function(ev) {
+		var msg = JSON.parse(ev.data);
+		if (msg.kind == "state") {
+			var out = document.getElementById("output");
+			out.innerHTML = "<pre>" + escapeHTML(msg.output) + "</pre>";
+			out.className = msg.isError ? "error" : "";
+		}
+	};
+	ws.onclose = function() {
+		setTimeout(connect, 1000);
+	};
+}
+
+function next() { ws.send(JSON.stringify({kind: "next"})); }
+function prev() { ws.send(JSON.stringify({kind: "prev"})); }
+
+function runCompile() {
+	var prog = document.getElementById("edit").value;
+	ws.send(JSON.stringify({kind: "compile", data: prog}));
+}
+
+window.onload = connect;
+</script>
+</head>
+<body>
+{{if .Title}}<h2>{{.Title}}</h2>{{end}}
+{{if .Presenter}}
+<textarea id="edit" spellcheck="false">{{printf "%s" .Contents |html}}</textarea>
+<div class="hints">
+<button onclick="runCompile()">Compile and run</button>
+<button onclick="prev()">Previous</button>
+<button onclick="next()">Next</button>
+</div>
+{{else}}
+<pre>{{printf "%s" .Contents |html}}</pre>
+{{end}}
+<div id="output"></div>
 </body>
 </html>
 `
@@ -0,0 +1,209 @@
+// Copyright 2013 Christopher Swenson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// wsGUID is the magic value RFC 6455 defines for computing
+// Sec-WebSocket-Accept from the client's Sec-WebSocket-Key.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes this package understands; sliderepl only ever sends and
+// receives text frames plus the control frames needed to close a
+// connection cleanly.
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+// maxFrameBytes bounds a single incoming frame's declared payload
+// length. Without a cap, a client can claim a length near 2^63 in the
+// frame header and make readFrame allocate that much before the read
+// ever fails, a cheap way to OOM the server from an untrusted
+// /compilews or /session connection.
+const maxFrameBytes = 1 << 20 // 1 MiB
+
+// wsConn is a minimal, server-side RFC 6455 WebSocket connection: just
+// enough unfragmented text-frame read/write to carry /compilews's
+// small JSON control messages, without pulling in a third-party
+// dependency for it.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	// writeMu serializes writeFrame calls. Callers read in a loop on
+	// one goroutine while writing replies from another (e.g. a
+	// broadcast or event-forwarding goroutine alongside ReadMessage's
+	// own pong/close replies); writeFrame's header and payload are two
+	// separate conn.Write calls, so unsynchronized callers can
+	// interleave their frames on the wire.
+	writeMu sync.Mutex
+}
+
+// wsUpgrade performs the WebSocket handshake over an existing HTTP
+// request by hijacking its connection. The caller must not write to w
+// after a successful upgrade.
+func wsUpgrade(w http.ResponseWriter, req *http.Request) (*wsConn, error) {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return nil, errors.New("sliderepl: not a websocket upgrade request")
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("sliderepl: missing Sec-WebSocket-Key")
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("sliderepl: ResponseWriter does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	accept := base64.StdEncoding.EncodeToString(sum[:])
+
+	if _, err := fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", accept); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{conn: conn, br: rw.Reader}, nil
+}
+
+func (c *wsConn) Close() error { return c.conn.Close() }
+
+// WriteText sends data as a single unfragmented, unmasked text frame
+// (servers must not mask frames they send).
+func (c *wsConn) WriteText(data []byte) error {
+	return c.writeFrame(wsOpText, data)
+}
+
+func (c *wsConn) writeFrame(opcode byte, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var header []byte
+	header = append(header, 0x80|opcode) // FIN + opcode
+
+	n := len(data)
+	switch {
+	case n <= 125:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126)
+		var ext [2]byte
+		binary.BigEndian.PutUint16(ext[:], uint16(n))
+		header = append(header, ext[:]...)
+	default:
+		header = append(header, 127)
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		header = append(header, ext[:]...)
+	}
+
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// ReadMessage returns the next text or binary message, transparently
+// answering pings and stopping at the first close frame (returning
+// io.EOF). It does not support fragmented messages, which sliderepl's
+// small control/streaming payloads never need.
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsOpText:
+			return payload, nil
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+		case wsOpPong:
+			// ignore
+		case wsOpClose:
+			c.writeFrame(wsOpClose, nil)
+			return nil, io.EOF
+		default:
+			return nil, fmt.Errorf("sliderepl: unsupported websocket opcode %#x", opcode)
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.br, head[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode = head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if length > maxFrameBytes {
+		return 0, nil, fmt.Errorf("sliderepl: websocket frame too large (%d bytes)", length)
+	}
+
+	var maskKey [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.br, maskKey[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= maskKey[i%4]
+		}
+	}
+	return opcode, payload, nil
+}
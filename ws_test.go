@@ -0,0 +1,59 @@
+// Copyright 2013 Christopher Swenson. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// TestReadFrameRejectsOversizedLength checks that a frame header
+// claiming a payload far beyond maxFrameBytes is rejected before
+// readFrame allocates a buffer for it, rather than trusting the
+// unvalidated length an untrusted /compilews or /session client sent.
+func TestReadFrameRejectsOversizedLength(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteByte(0x80 | wsOpText) // FIN + text opcode
+	buf.WriteByte(0x80 | 127)      // masked + 8-byte extended length follows
+	var ext [8]byte
+	binary.BigEndian.PutUint64(ext[:], maxFrameBytes+1)
+	buf.Write(ext[:])
+
+	c := &wsConn{br: bufio.NewReader(&buf)}
+	if _, _, err := c.readFrame(); err == nil {
+		t.Fatal("readFrame: want an error for a frame claiming more than maxFrameBytes, got nil")
+	}
+}
+
+// TestReadFrameAllowsLengthAtCap checks that maxFrameBytes itself is
+// still accepted, i.e. the cap isn't off by one.
+func TestReadFrameAllowsLengthAtCap(t *testing.T) {
+	payload := make([]byte, 4)
+	mask := [4]byte{1, 2, 3, 4}
+	masked := make([]byte, len(payload))
+	for i, b := range payload {
+		masked[i] = b ^ mask[i%4]
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(0x80 | wsOpText)
+	buf.WriteByte(0x80 | 127)
+	var ext [8]byte
+	binary.BigEndian.PutUint64(ext[:], uint64(len(payload)))
+	buf.Write(ext[:])
+	buf.Write(mask[:])
+	buf.Write(masked)
+
+	c := &wsConn{br: bufio.NewReader(&buf)}
+	opcode, got, err := c.readFrame()
+	if err != nil {
+		t.Fatalf("readFrame: unexpected error: %v", err)
+	}
+	if opcode != wsOpText || !bytes.Equal(got, payload) {
+		t.Errorf("readFrame = (%#x, %q), want (%#x, %q)", opcode, got, wsOpText, payload)
+	}
+}